@@ -0,0 +1,565 @@
+package xpulsar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin functions talk to the Pulsar admin REST API. Their adminClient
+// argument is the base URL of the admin service, e.g. http://localhost:8080.
+
+var adminHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// adminDo sends a request with an optional JSON body to the admin API and
+// decodes a JSON response into out when out is not nil. A *string out
+// receives the raw response body instead.
+func (p *PubSub) adminDo(method, adminClient, path string, body, out interface{}) error {
+	if body == nil {
+		return p.adminSend(method, adminClient, path, "", nil, out)
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return p.adminSend(method, adminClient, path, "application/json", bytes.NewReader(encoded), out)
+}
+
+// adminSend is adminDo for a request body that is already encoded as
+// contentType.
+func (p *PubSub) adminSend(method, adminClient, path, contentType string, body io.Reader, out interface{}) error {
+	ctx := p.vu.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(adminClient, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := adminHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("xk6-pulsar: admin %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *string:
+		raw, err := io.ReadAll(resp.Body)
+		*out = string(raw)
+		return err
+	default:
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+// adminTopicPath returns the admin API path of topic, e.g.
+// /admin/v2/persistent/public/default/my-topic.
+func adminTopicPath(topic string) (string, error) {
+	c, err := parseTopicURL(topic)
+	if err != nil {
+		return "", err
+	}
+	name := c.Topic
+	if c.Partition != "" {
+		name += partitionSuffix + c.Partition
+	}
+	return fmt.Sprintf("/admin/v2/%s/%s/%s/%s", c.Persistence, c.Tenant, c.Namespace, name), nil
+}
+
+// adminPartitionCount returns the number of partitions of the topic at path,
+// 0 for a topic that is not partitioned.
+func (p *PubSub) adminPartitionCount(adminClient, path string) (int, error) {
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	if err := p.adminDo(http.MethodGet, adminClient, path+"/partitions", nil, &metadata); err != nil {
+		return 0, err
+	}
+	return metadata.Partitions, nil
+}
+
+// adminTopicStats returns the stats of topic. The broker only serves
+// partitioned stats, which aggregate those of every partition, for the base
+// name of a partitioned topic.
+func (p *PubSub) adminTopicStats(adminClient, topic string) (map[string]interface{}, error) {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	statsPath := path + "/stats"
+	if c, _ := parseTopicURL(topic); c.Partition == "" {
+		partitions, err := p.adminPartitionCount(adminClient, path)
+		if err != nil {
+			return nil, err
+		}
+		if partitions > 0 {
+			statsPath = path + "/partitioned-stats"
+		}
+	}
+
+	var stats map[string]interface{}
+	if err := p.adminDo(http.MethodGet, adminClient, statsPath, nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// AdminGetSubscriptionStats returns the broker-side stats of one subscription
+// on topic: msgBacklog, msgRateOut, msgThroughputOut and consumerCount.
+func (p *PubSub) AdminGetSubscriptionStats(adminClient, topic, subscription string) (map[string]interface{}, error) {
+	stats, err := p.adminTopicStats(adminClient, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions, _ := stats["subscriptions"].(map[string]interface{})
+	sub, ok := subscriptions[subscription].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("xk6-pulsar: subscription %q not found on topic %s", subscription, topic)
+	}
+
+	consumers, _ := sub["consumers"].([]interface{})
+	return map[string]interface{}{
+		"msgBacklog":       sub["msgBacklog"],
+		"msgRateOut":       sub["msgRateOut"],
+		"msgThroughputOut": sub["msgThroughputOut"],
+		"consumerCount":    len(consumers),
+	}, nil
+}
+
+// AdminGetProducerStats returns the broker-side stats of the producer named
+// producerName on topic: msgRateIn, msgThroughputIn, averageMsgSize and
+// chunkedMessageRate.
+func (p *PubSub) AdminGetProducerStats(adminClient, topic, producerName string) (map[string]interface{}, error) {
+	stats, err := p.adminTopicStats(adminClient, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	publishers, _ := stats["publishers"].([]interface{})
+	for _, publisher := range publishers {
+		pub, ok := publisher.(map[string]interface{})
+		if !ok || pub["producerName"] != producerName {
+			continue
+		}
+		return map[string]interface{}{
+			"msgRateIn":          pub["msgRateIn"],
+			"msgThroughputIn":    pub["msgThroughputIn"],
+			"averageMsgSize":     pub["averageMsgSize"],
+			"chunkedMessageRate": pub["chunkedMessageRate"],
+		}, nil
+	}
+	return nil, fmt.Errorf("xk6-pulsar: producer %q not found on topic %s", producerName, topic)
+}
+
+func adminNamespacePath(tenant, namespace string) string {
+	return fmt.Sprintf("/admin/v2/namespaces/%s/%s", tenant, namespace)
+}
+
+// AdminSetMessageTTL sets the message time to live of a namespace.
+func (p *PubSub) AdminSetMessageTTL(adminClient, tenant, namespace string, ttlSeconds int) error {
+	return p.adminDo(http.MethodPost, adminClient, adminNamespacePath(tenant, namespace)+"/messageTTL", ttlSeconds, nil)
+}
+
+// AdminSetRetentionPolicy sets the retention policy of a namespace. Pass -1
+// for both values to retain messages forever.
+func (p *PubSub) AdminSetRetentionPolicy(
+	adminClient, tenant, namespace string,
+	retentionSizeMB, retentionTimeMinutes int,
+) error {
+	policy := map[string]int{
+		"retentionSizeInMB":      retentionSizeMB,
+		"retentionTimeInMinutes": retentionTimeMinutes,
+	}
+	return p.adminDo(http.MethodPost, adminClient, adminNamespacePath(tenant, namespace)+"/retention", policy, nil)
+}
+
+// AdminSetBacklogQuota sets the backlog quota of a namespace. policy is
+// "consumer_backlog_eviction" or "producer_exception".
+func (p *PubSub) AdminSetBacklogQuota(adminClient, tenant, namespace string, limitBytes int64, policy string) error {
+	switch policy {
+	case "consumer_backlog_eviction", "producer_exception":
+	default:
+		return fmt.Errorf("xk6-pulsar: invalid backlog quota policy %q", policy)
+	}
+
+	quota := map[string]interface{}{
+		"limitSize": limitBytes,
+		"policy":    policy,
+	}
+	return p.adminDo(http.MethodPost, adminClient, adminNamespacePath(tenant, namespace)+"/backlogQuota", quota, nil)
+}
+
+// AdminGetBrokerHealth runs the broker health check and reports whether the
+// broker answered "ok".
+func (p *PubSub) AdminGetBrokerHealth(adminClient string) (bool, error) {
+	var status string
+	if err := p.adminDo(http.MethodGet, adminClient, "/admin/v2/brokers/health", nil, &status); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(status) == "ok", nil
+}
+
+// AdminListBrokers returns the active brokers of the cluster.
+func (p *PubSub) AdminListBrokers(adminClient string) ([]string, error) {
+	var brokers []string
+	if err := p.adminDo(http.MethodGet, adminClient, "/admin/v2/brokers", nil, &brokers); err != nil {
+		return nil, err
+	}
+	return brokers, nil
+}
+
+// AdminCreateTenant creates tenant with access to allowedClusters.
+func (p *PubSub) AdminCreateTenant(adminClient, tenant string, allowedClusters []string) error {
+	info := map[string]interface{}{
+		"adminRoles":      []string{},
+		"allowedClusters": allowedClusters,
+	}
+	return p.adminDo(http.MethodPut, adminClient, "/admin/v2/tenants/"+tenant, info, nil)
+}
+
+// AdminDeleteTenant deletes tenant. The broker refuses, and an error is
+// returned, while the tenant still has namespaces.
+func (p *PubSub) AdminDeleteTenant(adminClient, tenant string) error {
+	return p.adminDo(http.MethodDelete, adminClient, "/admin/v2/tenants/"+tenant, nil, nil)
+}
+
+// AdminGetNamespacePolicies returns all policies of a namespace.
+func (p *PubSub) AdminGetNamespacePolicies(adminClient, tenant, namespace string) (map[string]interface{}, error) {
+	var policies map[string]interface{}
+	if err := p.adminDo(http.MethodGet, adminClient, adminNamespacePath(tenant, namespace), nil, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// AdminTriggerOffload offloads the closed ledgers of topic, up to its last
+// confirmed entry, to the tiered storage configured on the broker.
+func (p *PubSub) AdminTriggerOffload(adminClient, topic string) error {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return err
+	}
+
+	var internalStats struct {
+		LastConfirmedEntry string `json:"lastConfirmedEntry"`
+	}
+	if err := p.adminDo(http.MethodGet, adminClient, path+"/internalStats", nil, &internalStats); err != nil {
+		return err
+	}
+
+	var ledgerID, entryID int64
+	if _, err := fmt.Sscanf(internalStats.LastConfirmedEntry, "%d:%d", &ledgerID, &entryID); err != nil {
+		return fmt.Errorf("xk6-pulsar: unexpected last confirmed entry %q for topic %s: %w",
+			internalStats.LastConfirmedEntry, topic, err)
+	}
+
+	messageID := map[string]int64{
+		"ledgerId":       ledgerID,
+		"entryId":        entryID,
+		"partitionIndex": -1,
+	}
+	return p.adminDo(http.MethodPut, adminClient, path+"/offload", messageID, nil)
+}
+
+// AdminGetOffloadPolicies returns the offload policies set on topic.
+func (p *PubSub) AdminGetOffloadPolicies(adminClient, topic string) (map[string]interface{}, error) {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies map[string]interface{}
+	if err := p.adminDo(http.MethodGet, adminClient, path+"/offloadPolicies", nil, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// DispatchRate is a broker dispatch rate limit. -1 disables a limit.
+type DispatchRate struct {
+	DispatchThrottlingRateInMsg  int   `json:"dispatchThrottlingRateInMsg"`
+	DispatchThrottlingRateInByte int64 `json:"dispatchThrottlingRateInByte"`
+	RatePeriodInSecond           int   `json:"ratePeriodInSecond"`
+	RelativeToPublishRate        bool  `json:"relativeToPublishRate"`
+}
+
+// AdminSetNamespaceDispatchRate sets the dispatch rate of every topic in a
+// namespace.
+func (p *PubSub) AdminSetNamespaceDispatchRate(adminClient, tenant, namespace string, rate DispatchRate) error {
+	if rate.RatePeriodInSecond <= 0 {
+		rate.RatePeriodInSecond = 1
+	}
+	return p.adminDo(http.MethodPost, adminClient, adminNamespacePath(tenant, namespace)+"/dispatchRate", rate, nil)
+}
+
+// AdminSetPublishRate limits the rate at which producers can publish to
+// topic. The broker only accepts whole messages per second, so msgRatePerSec
+// is rounded.
+func (p *PubSub) AdminSetPublishRate(adminClient, topic string, msgRatePerSec float64, byteRatePerSec int64) error {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return err
+	}
+
+	rate := map[string]interface{}{
+		"publishThrottlingRateInMsg":  int(math.Round(msgRatePerSec)),
+		"publishThrottlingRateInByte": byteRatePerSec,
+	}
+	return p.adminDo(http.MethodPost, adminClient, path+"/publishRate", rate, nil)
+}
+
+// AdminSetSubscribeRate limits how many subscriptions each consumer can
+// create per ratePeriodSeconds in a namespace. ratePeriodSeconds defaults to
+// 1 when unset. The broker only accepts whole numbers, so
+// subsPerConsumerPerSecond is rounded.
+func (p *PubSub) AdminSetSubscribeRate(
+	adminClient, tenant, namespace string,
+	subsPerConsumerPerSecond float64, ratePeriodSeconds int,
+) error {
+	if ratePeriodSeconds <= 0 {
+		ratePeriodSeconds = 1
+	}
+	rate := map[string]int{
+		"subscribeThrottlingRatePerConsumer": int(math.Round(subsPerConsumerPerSecond)),
+		"ratePeriodInSecond":                 ratePeriodSeconds,
+	}
+	return p.adminDo(http.MethodPost, adminClient, adminNamespacePath(tenant, namespace)+"/subscribeRate", rate, nil)
+}
+
+// AdminGetReplicationStatus returns the replication stats of topic towards
+// remoteCluster: msgRateOut, msgThroughputOut, replicationBacklog and
+// connected.
+func (p *PubSub) AdminGetReplicationStatus(adminClient, topic, remoteCluster string) (map[string]interface{}, error) {
+	stats, err := p.adminTopicStats(adminClient, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	replication, _ := stats["replication"].(map[string]interface{})
+	replicator, ok := replication[remoteCluster].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("xk6-pulsar: topic %s is not replicated to cluster %q", topic, remoteCluster)
+	}
+	return map[string]interface{}{
+		"msgRateOut":         replicator["msgRateOut"],
+		"msgThroughputOut":   replicator["msgThroughputOut"],
+		"replicationBacklog": replicator["replicationBacklog"],
+		"connected":          replicator["connected"],
+	}, nil
+}
+
+// AdminTriggerFunction triggers a Pulsar Function with payload as if it had
+// been published to inputTopic, and returns the function's output. The
+// payload is sent in the "data" form field the trigger endpoint reads.
+func (p *PubSub) AdminTriggerFunction(
+	adminClient, tenant, namespace, functionName, inputTopic string,
+	payload []byte,
+) (string, error) {
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	if err := w.WriteField("data", string(payload)); err != nil {
+		return "", err
+	}
+	if err := w.WriteField("topic", inputTopic); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	var output string
+	path := fmt.Sprintf("/admin/v3/functions/%s/%s/%s/trigger", tenant, namespace, functionName)
+	if err := p.adminSend(http.MethodPost, adminClient, path, w.FormDataContentType(), &form, &output); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// instancesStatus is the common shape of the function, sink and source status
+// responses. Each instance's status is kept as a map because the counters
+// differ between the three.
+type instancesStatus struct {
+	NumInstances int `json:"numInstances"`
+	NumRunning   int `json:"numRunning"`
+	Instances    []struct {
+		Status map[string]interface{} `json:"status"`
+	} `json:"instances"`
+}
+
+// sum adds up the numeric fields of every instance status.
+func (s *instancesStatus) sum(fields ...string) float64 {
+	var total float64
+	for _, instance := range s.Instances {
+		for _, field := range fields {
+			n, _ := instance.Status[field].(float64)
+			total += n
+		}
+	}
+	return total
+}
+
+// latest returns the highest value of a timestamp field across instances.
+func (s *instancesStatus) latest(field string) float64 {
+	var latest float64
+	for _, instance := range s.Instances {
+		if n, _ := instance.Status[field].(float64); n > latest {
+			latest = n
+		}
+	}
+	return latest
+}
+
+// AdminGetFunctionStatus returns the number of instances and running
+// instances of a Pulsar Function, its failure count and its last invocation
+// time in milliseconds since the epoch.
+func (p *PubSub) AdminGetFunctionStatus(
+	adminClient, tenant, namespace, functionName string,
+) (map[string]interface{}, error) {
+	var status instancesStatus
+	path := fmt.Sprintf("/admin/v3/functions/%s/%s/%s/status", tenant, namespace, functionName)
+	if err := p.adminDo(http.MethodGet, adminClient, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"numInstances":       status.NumInstances,
+		"numRunning":         status.NumRunning,
+		"failureCount":       status.sum("numUserExceptions", "numSystemExceptions"),
+		"lastInvocationTime": status.latest("lastInvocationTime"),
+	}, nil
+}
+
+// AdminGetSinkStatus returns the number of instances and running instances
+// of a Pulsar IO sink, its failure count and the last time it received a
+// message, in milliseconds since the epoch.
+func (p *PubSub) AdminGetSinkStatus(adminClient, tenant, namespace, sinkName string) (map[string]interface{}, error) {
+	var status instancesStatus
+	path := fmt.Sprintf("/admin/v3/sinks/%s/%s/%s/status", tenant, namespace, sinkName)
+	if err := p.adminDo(http.MethodGet, adminClient, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"numInstances":       status.NumInstances,
+		"numRunning":         status.NumRunning,
+		"failureCount":       status.sum("numSinkExceptions", "numSystemExceptions"),
+		"lastInvocationTime": status.latest("lastReceivedTime"),
+	}, nil
+}
+
+// AdminGetSourceStatus returns the number of instances and running instances
+// of a Pulsar IO source, the records it wrote to Pulsar and its error count.
+func (p *PubSub) AdminGetSourceStatus(adminClient, tenant, namespace, sourceName string) (map[string]interface{}, error) {
+	var status instancesStatus
+	path := fmt.Sprintf("/admin/v3/sources/%s/%s/%s/status", tenant, namespace, sourceName)
+	if err := p.adminDo(http.MethodGet, adminClient, path, nil, &status); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"numInstances":   status.NumInstances,
+		"numRunning":     status.NumRunning,
+		"recordsWritten": status.sum("numWritten"),
+		"errorCount":     status.sum("numSourceExceptions", "numSystemExceptions"),
+	}, nil
+}
+
+// AdminCreateNonPartitionedTopic creates topic without partitions.
+func (p *PubSub) AdminCreateNonPartitionedTopic(adminClient, topic string) error {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return err
+	}
+	return p.adminDo(http.MethodPut, adminClient, path, nil, nil)
+}
+
+// AdminCreatePartitionedTopic creates topic with numPartitions partitions.
+func (p *PubSub) AdminCreatePartitionedTopic(adminClient, topic string, numPartitions int) error {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return err
+	}
+	return p.adminDo(http.MethodPut, adminClient, path+"/partitions", numPartitions, nil)
+}
+
+func (p *PubSub) adminListTopics(adminClient, tenant, namespace, suffix string) ([]string, error) {
+	var topics []string
+	path := fmt.Sprintf("/admin/v2/persistent/%s/%s%s", tenant, namespace, suffix)
+	if err := p.adminDo(http.MethodGet, adminClient, path, nil, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// AdminListNonPartitionedTopics returns the persistent topics of a namespace
+// that are not partitioned. The broker lists the partitions of partitioned
+// topics as topics of their own; those are left out.
+func (p *PubSub) AdminListNonPartitionedTopics(adminClient, tenant, namespace string) ([]string, error) {
+	topics, err := p.adminListTopics(adminClient, tenant, namespace, "")
+	if err != nil {
+		return nil, err
+	}
+	partitioned, err := p.AdminListPartitionedTopics(adminClient, tenant, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	isPartitioned := make(map[string]bool, len(partitioned))
+	for _, topic := range partitioned {
+		isPartitioned[topic] = true
+	}
+
+	nonPartitioned := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if i := strings.LastIndex(topic, partitionSuffix); i > 0 && isPartitioned[topic[:i]] {
+			continue
+		}
+		nonPartitioned = append(nonPartitioned, topic)
+	}
+	return nonPartitioned, nil
+}
+
+// AdminListPartitionedTopics returns the partitioned persistent topics of a
+// namespace.
+func (p *PubSub) AdminListPartitionedTopics(adminClient, tenant, namespace string) ([]string, error) {
+	return p.adminListTopics(adminClient, tenant, namespace, "/partitioned")
+}
+
+// AdminUpdatePartitionedTopic raises the partition count of topic to
+// numPartitions. Partitions can only be added, so a count that is not higher
+// than the current one is rejected before the update is sent.
+func (p *PubSub) AdminUpdatePartitionedTopic(adminClient, topic string, numPartitions int) error {
+	path, err := adminTopicPath(topic)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := p.adminPartitionCount(adminClient, path)
+	if err != nil {
+		return err
+	}
+	if numPartitions <= partitions {
+		return fmt.Errorf("xk6-pulsar: topic %s has %d partitions, the count can only be increased, got %d",
+			topic, partitions, numPartitions)
+	}
+
+	return p.adminDo(http.MethodPost, adminClient, path+"/partitions", numPartitions, nil)
+}
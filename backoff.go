@@ -0,0 +1,114 @@
+package xpulsar
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// BackoffPolicyConfig configures an exponential backoff with jitter. The
+// delay starts at MinBackoff, doubles on every attempt up to MaxBackoff and is
+// then moved randomly by up to JitterFactor (0..1) of its value.
+type BackoffPolicyConfig struct {
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	JitterFactor float64
+	// MaxRetries defaults to 3 when unset.
+	MaxRetries int
+}
+
+func (b *BackoffPolicyConfig) delay(attempt int) time.Duration {
+	minBackoff := 100 * time.Millisecond
+	if b.MinBackoff > 0 {
+		minBackoff = b.MinBackoff
+	}
+	maxBackoff := 10 * time.Second
+	if b.MaxBackoff > 0 {
+		maxBackoff = b.MaxBackoff
+	}
+
+	d := minBackoff << attempt
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	if b.JitterFactor > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.JitterFactor * float64(d))
+	}
+	return d
+}
+
+func (b *BackoffPolicyConfig) maxRetries() int {
+	if b.MaxRetries > 0 {
+		return b.MaxRetries
+	}
+	return 3
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient
+// or the retries of policy are used up. A nil policy calls fn once. When all
+// retries fail, the errors of every attempt are returned joined.
+func retry(policy *BackoffPolicyConfig, fn func() error) error {
+	err := fn()
+	if policy == nil || err == nil {
+		return err
+	}
+
+	errs := []error{err}
+	for attempt := 0; attempt < policy.maxRetries() && isTransient(err); attempt++ {
+		time.Sleep(policy.delay(attempt))
+		if err = fn(); err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if !isTransient(err) {
+		return err
+	}
+	return fmt.Errorf("xk6-pulsar: giving up after %d attempts: %w", len(errs), errors.Join(errs...))
+}
+
+// transientMessages are the texts of the transient errors pulsar-client-go
+// v0.8.0 returns as plain errors, without a *pulsar.Error.
+var transientMessages = []string{
+	// The connection to the broker failed or was closed.
+	"connection error",
+	"connection closed",
+	// internal.ErrRequestTimeOut, for lookups and producer creation.
+	"request timed out",
+	// Lookup and server errors while a broker is starting or overloaded.
+	"ServiceNotReady",
+	"TooManyRequests",
+}
+
+// isTransient reports whether err is a network or broker availability error
+// that is worth retrying.
+func isTransient(err error) bool {
+	// Lookups over http:// fail with the net errors of the HTTP client.
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pulsarErr *pulsar.Error
+	if errors.As(err, &pulsarErr) {
+		switch pulsarErr.Result() {
+		case pulsar.ConnectError, pulsar.LookupError, pulsar.TimeoutError,
+			pulsar.NotConnectedError, pulsar.ServiceUnitNotReady, pulsar.TooManyLookupRequestException:
+			return true
+		}
+		return false
+	}
+
+	msg := err.Error()
+	for _, transient := range transientMessages {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package xpulsar
+
+import (
+	"strings"
+	"sync"
+)
+
+// overflowTagValue replaces every tag value once the cardinality cap is hit.
+const overflowTagValue = "__overflow__"
+
+// cardinalityLimiter counts the distinct tag sets used by the extension's
+// metrics. It lives in the root module, so the cap applies across all VUs.
+type cardinalityLimiter struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// limit returns tags unchanged if the tag set has been seen before or fewer
+// than maxSets distinct sets have been seen so far. Otherwise it returns the
+// same keys with every value set to "__overflow__". maxSets <= 0 disables the
+// cap.
+func (c *cardinalityLimiter) limit(maxSets int, tags []string) []string {
+	if maxSets <= 0 {
+		return tags
+	}
+
+	key := strings.Join(tags, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.seen[key]; ok {
+		return tags
+	}
+	if len(c.seen) < maxSets {
+		c.seen[key] = struct{}{}
+		return tags
+	}
+
+	overflow := make([]string, len(tags))
+	for i := range tags {
+		if i%2 == 0 {
+			overflow[i] = tags[i]
+		} else {
+			overflow[i] = overflowTagValue
+		}
+	}
+	return overflow
+}
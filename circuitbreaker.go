@@ -0,0 +1,161 @@
+package xpulsar
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+
+	"go.k6.io/k6/metrics"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreakerProducer while its circuit is
+// open, without contacting the broker.
+var ErrCircuitOpen = errors.New("xk6-pulsar: circuit breaker is open")
+
+// CircuitBreakerConfig configures a CircuitBreakerProducer. After MaxFailures
+// consecutive failed sends the circuit opens and every send fails with
+// ErrCircuitOpen. Once ResetTimeout has passed, up to HalfOpenMaxRequests
+// sends are let through: a success closes the circuit, a failure opens it
+// again.
+type CircuitBreakerConfig struct {
+	MaxFailures         int
+	ResetTimeout        time.Duration
+	HalfOpenMaxRequests int
+}
+
+// circuitState values are also the values of the
+// pulsar.producer.circuit_breaker.state gauge.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+// CircuitBreakerProducer wraps a producer and stops sending to it while the
+// broker keeps failing. It is a pulsar.Producer, so it can be passed to
+// publish, flush and close like any other producer.
+type CircuitBreakerProducer struct {
+	pulsar.Producer
+	config CircuitBreakerConfig
+	pubsub *PubSub
+
+	mu               sync.Mutex
+	state            circuitState
+	failures         int
+	openedAt         time.Time
+	halfOpenRequests int
+}
+
+// NewCircuitBreakerProducer wraps producer in a circuit breaker. Unset config
+// fields default to 5 failures, a 30s reset timeout and 1 half-open request.
+func (p *PubSub) NewCircuitBreakerProducer(producer pulsar.Producer, config CircuitBreakerConfig) *CircuitBreakerProducer {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 5
+	}
+	if config.ResetTimeout <= 0 {
+		config.ResetTimeout = 30 * time.Second
+	}
+	if config.HalfOpenMaxRequests <= 0 {
+		config.HalfOpenMaxRequests = 1
+	}
+
+	return &CircuitBreakerProducer{
+		Producer: producer,
+		config:   config,
+		pubsub:   p,
+	}
+}
+
+func (cb *CircuitBreakerProducer) Send(ctx context.Context, msg *pulsar.ProducerMessage) (pulsar.MessageID, error) {
+	if err := cb.allow(ctx); err != nil {
+		return nil, err
+	}
+
+	id, err := cb.Producer.Send(ctx, msg)
+	cb.record(ctx, err)
+	return id, err
+}
+
+func (cb *CircuitBreakerProducer) SendAsync(
+	ctx context.Context,
+	msg *pulsar.ProducerMessage,
+	callback func(pulsar.MessageID, *pulsar.ProducerMessage, error),
+) {
+	if err := cb.allow(ctx); err != nil {
+		callback(nil, msg, err)
+		return
+	}
+
+	cb.Producer.SendAsync(ctx, msg, func(id pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
+		cb.record(ctx, err)
+		callback(id, pm, err)
+	})
+}
+
+// allow returns ErrCircuitOpen when a send must not go through.
+func (cb *CircuitBreakerProducer) allow(ctx context.Context) error {
+	cb.mu.Lock()
+	changed := false
+	if cb.state == circuitOpen && time.Since(cb.openedAt) >= cb.config.ResetTimeout {
+		cb.state = circuitHalfOpen
+		cb.halfOpenRequests = 0
+		changed = true
+	}
+
+	var err error
+	switch {
+	case cb.state == circuitOpen:
+		err = ErrCircuitOpen
+	case cb.state == circuitHalfOpen && cb.halfOpenRequests >= cb.config.HalfOpenMaxRequests:
+		err = ErrCircuitOpen
+	case cb.state == circuitHalfOpen:
+		cb.halfOpenRequests++
+	}
+	state := cb.state
+	cb.mu.Unlock()
+
+	if changed {
+		cb.reportState(ctx, state)
+	}
+	return err
+}
+
+// record updates the circuit with the outcome of a send.
+func (cb *CircuitBreakerProducer) record(ctx context.Context, sendErr error) {
+	cb.mu.Lock()
+	previous := cb.state
+	if sendErr == nil {
+		cb.failures = 0
+		cb.state = circuitClosed
+	} else {
+		cb.failures++
+		if cb.state == circuitHalfOpen || cb.failures >= cb.config.MaxFailures {
+			cb.state = circuitOpen
+			cb.openedAt = time.Now()
+		}
+	}
+	state := cb.state
+	cb.mu.Unlock()
+
+	if state != previous {
+		cb.reportState(ctx, state)
+	}
+}
+
+func (cb *CircuitBreakerProducer) reportState(ctx context.Context, state circuitState) {
+	vuState := cb.pubsub.vu.State()
+	if vuState == nil {
+		log.Printf("could not report circuit breaker state: %v", errNilStateOfStats)
+		return
+	}
+
+	tags := metrics.NewTags(cb.pubsub.stateTags(cb.Name(), cb.Topic())...)
+	cb.pubsub.metrics.CircuitBreakerState.WithTags(tags).Set(float64(state))
+	metrics.PushIfNotDone(ctx, vuState.Samples)
+}
@@ -0,0 +1,59 @@
+package xpulsar
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// moduleConfig holds the module-wide settings. They are read from the
+// environment of the k6 process, e.g. XK6_PULSAR_METRICS_PREFIX=myapp. ./k6 run,
+// so every instance of the module in a test shares them.
+type moduleConfig struct {
+	// MetricsPrefix is prepended to the name of every metric.
+	MetricsPrefix string
+	// MaxMetricCardinality caps the distinct tag sets of the metrics; tag
+	// sets beyond it are reported as "__overflow__". Zero means no cap.
+	MaxMetricCardinality int
+	// IncludeVUTag adds a vu_id tag to the metrics, except the gauges of the
+	// producer state. It is off by default, since every VU then reports its
+	// own series.
+	IncludeVUTag bool
+	// IncludeIterationTag adds an iteration tag to the metrics, except the
+	// gauges of the producer state, so that they can be compared across
+	// iterations. It is off by default.
+	IncludeIterationTag bool
+}
+
+func loadModuleConfig(lookupEnv func(key string) (string, bool)) (moduleConfig, error) {
+	var config moduleConfig
+	if lookupEnv == nil {
+		return config, nil
+	}
+
+	config.MetricsPrefix, _ = lookupEnv("XK6_PULSAR_METRICS_PREFIX")
+
+	if v, ok := lookupEnv("XK6_PULSAR_MAX_METRIC_CARDINALITY"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("xk6-pulsar: invalid XK6_PULSAR_MAX_METRIC_CARDINALITY %q: %w", v, err)
+		}
+		config.MaxMetricCardinality = n
+	}
+
+	if v, ok := lookupEnv("XK6_PULSAR_INCLUDE_VU_TAG"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("xk6-pulsar: invalid XK6_PULSAR_INCLUDE_VU_TAG %q: %w", v, err)
+		}
+		config.IncludeVUTag = b
+	}
+
+	if v, ok := lookupEnv("XK6_PULSAR_INCLUDE_ITERATION_TAG"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("xk6-pulsar: invalid XK6_PULSAR_INCLUDE_ITERATION_TAG %q: %w", v, err)
+		}
+		config.IncludeIterationTag = b
+	}
+	return config, nil
+}
@@ -0,0 +1,95 @@
+package xpulsar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// Sentinel errors for the Pulsar failures scripts most often need to tell
+// apart. PulsarError matches them, so errors.Is works on the result.
+var (
+	ErrProducerClosed = errors.New("xk6-pulsar: producer is closed")
+	ErrConsumerClosed = errors.New("xk6-pulsar: consumer is closed")
+	ErrTimeout        = errors.New("xk6-pulsar: operation timed out")
+	ErrDuplicate      = errors.New("xk6-pulsar: message was dropped as a duplicate")
+	ErrProducerFenced = errors.New("xk6-pulsar: producer was fenced")
+)
+
+// isDuplicate reports whether id is the -1:-1 message ID the broker returns
+// for a message it dropped because of deduplication.
+func isDuplicate(id pulsar.MessageID) bool {
+	return id != nil && id.LedgerID() == -1 && id.EntryID() == -1
+}
+
+// PulsarError is returned in place of a *pulsar.Error. Code is the
+// pulsar.Result reported by the client. Topic is empty for failures of the
+// client itself. It is not part of the message, since the callers already add
+// it to the errors they return.
+type PulsarError struct {
+	Code    int
+	Message string
+	Topic   string
+
+	err      error
+	sentinel error
+}
+
+func (e *PulsarError) Error() string {
+	return "xk6-pulsar: " + e.Message
+}
+
+func (e *PulsarError) Unwrap() error {
+	return e.err
+}
+
+// Is matches the sentinel error of e, so that errors.Is finds it while
+// errors.As still finds the *pulsar.Error it was converted from.
+func (e *PulsarError) Is(target error) bool {
+	return e.sentinel != nil && target == e.sentinel
+}
+
+// invalidConfiguration returns err as a PulsarError with the
+// InvalidConfiguration code the client uses for bad options.
+func invalidConfiguration(err error) error {
+	return &PulsarError{
+		Code:    int(pulsar.InvalidConfiguration),
+		Message: err.Error(),
+		err:     err,
+	}
+}
+
+// wrapPulsarError converts a *pulsar.Error into a PulsarError for topic and
+// wraps fencing errors in ErrProducerFenced. Other errors, including ones that
+// merely wrap a *pulsar.Error, are returned unchanged so their context is
+// kept.
+func wrapPulsarError(err error, topic string) error {
+	// The client reports broker errors such as ProducerFenced only as text,
+	// e.g. "server error: ProducerFenced: ...".
+	if strings.Contains(err.Error(), "ProducerFenced") {
+		return fmt.Errorf("%w: %v", ErrProducerFenced, err)
+	}
+
+	pulsarErr, ok := err.(*pulsar.Error) //nolint:errorlint // only direct client errors are converted
+	if !ok {
+		return err
+	}
+
+	wrapped := &PulsarError{
+		Code:    int(pulsarErr.Result()),
+		Message: pulsarErr.Error(),
+		Topic:   topic,
+		err:     pulsarErr,
+	}
+	switch pulsarErr.Result() {
+	case pulsar.ProducerClosed:
+		wrapped.sentinel = ErrProducerClosed
+	case pulsar.ConsumerClosed:
+		wrapped.sentinel = ErrConsumerClosed
+	case pulsar.TimeoutError:
+		wrapped.sentinel = ErrTimeout
+	}
+	return wrapped
+}
@@ -0,0 +1,47 @@
+package xpulsar
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/dop251/goja"
+)
+
+// ProducerInterceptorConfig names a global JS function that is called with
+// every message before it is sent, e.g. `globalThis.addTrace = (msg) => {...}`.
+// The function may mutate the message key and properties.
+type ProducerInterceptorConfig struct {
+	Function string
+}
+
+// jsProducerInterceptor calls a JS function from BeforeSend. The Pulsar client
+// calls BeforeSend from the goroutine calling Send/SendAsync, which is the VU
+// goroutine, so it is safe to use the runtime there.
+type jsProducerInterceptor struct {
+	rt   *goja.Runtime
+	name string
+	fn   goja.Callable
+}
+
+func newJSProducerInterceptor(rt *goja.Runtime, config ProducerInterceptorConfig) (*jsProducerInterceptor, error) {
+	fn, ok := goja.AssertFunction(rt.GlobalObject().Get(config.Function))
+	if !ok {
+		return nil, fmt.Errorf("xk6-pulsar: interceptor %q is not a global function", config.Function)
+	}
+	return &jsProducerInterceptor{rt: rt, name: config.Function, fn: fn}, nil
+}
+
+func (i *jsProducerInterceptor) BeforeSend(_ pulsar.Producer, msg *pulsar.ProducerMessage) {
+	if msg.Properties == nil {
+		msg.Properties = map[string]string{}
+	}
+	if _, err := i.fn(goja.Undefined(), i.rt.ToValue(msg)); err != nil {
+		log.Printf("producer interceptor %s failed: %v", i.name, err)
+	}
+}
+
+// OnSendAcknowledgement is called from the producer's event loop, where the
+// runtime must not be used, so acknowledgements are not forwarded to JS.
+func (i *jsProducerInterceptor) OnSendAcknowledgement(pulsar.Producer, *pulsar.ProducerMessage, pulsar.MessageID) {
+}
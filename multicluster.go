@@ -0,0 +1,76 @@
+package xpulsar
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// MultiClusterClientConfig lists the clusters of a geo-replication test. Each
+// entry needs a unique ClusterName.
+type MultiClusterClientConfig struct {
+	ClusterConfigs []PulsarClientConfig
+}
+
+// MultiClusterClient holds one client per cluster. Scripts get the client of
+// a cluster with mc.client(name) to create producers on it.
+type MultiClusterClient struct {
+	clients map[string]pulsar.Client
+}
+
+// Client returns the client of clusterName, or nil if there is none.
+func (mc *MultiClusterClient) Client(clusterName string) pulsar.Client {
+	return mc.clients[clusterName]
+}
+
+// Close closes the clients of all clusters.
+func (mc *MultiClusterClient) Close() {
+	for _, client := range mc.clients {
+		client.Close()
+	}
+}
+
+// CreateMultiClusterClient creates a client for every cluster in config. If
+// one of them fails, the clients created so far are closed.
+func (p *PubSub) CreateMultiClusterClient(config MultiClusterClientConfig) (*MultiClusterClient, error) {
+	mc := &MultiClusterClient{clients: make(map[string]pulsar.Client, len(config.ClusterConfigs))}
+	for _, clusterConfig := range config.ClusterConfigs {
+		name := clusterConfig.ClusterName
+		if name == "" {
+			mc.Close()
+			return nil, errors.New("xk6-pulsar: cluster name must not be empty")
+		}
+		if _, ok := mc.clients[name]; ok {
+			mc.Close()
+			return nil, fmt.Errorf("xk6-pulsar: duplicate cluster %q", name)
+		}
+
+		client, err := p.CreateClient(clusterConfig)
+		if err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("xk6-pulsar: cluster %q: %w", name, err)
+		}
+		mc.clients[name] = client
+	}
+	return mc, nil
+}
+
+// PublishToCluster synchronously publishes body with producer, after
+// checking that producer was created from the client of clusterName.
+func (p *PubSub) PublishToCluster(
+	mc *MultiClusterClient,
+	clusterName string,
+	producer pulsar.Producer,
+	body []byte,
+	props map[string]string,
+) error {
+	client, ok := mc.clients[clusterName]
+	if !ok {
+		return fmt.Errorf("xk6-pulsar: unknown cluster %q", clusterName)
+	}
+	if cp, ok := asConfiguredProducer(producer); ok && cp.client != client {
+		return fmt.Errorf("xk6-pulsar: producer for topic %s does not belong to cluster %q", cp.config.Topic, clusterName)
+	}
+	return p.Publish(p.vu.Context(), producer, body, props, false)
+}
@@ -0,0 +1,156 @@
+package xpulsar
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"golang.org/x/time/rate"
+)
+
+// configuredProducer keeps the ProducerConfig next to the pulsar.Producer it
+// was created from, so Publish can apply the per-message options of that
+// config. The underlying producer can be replaced after a failed batch, so it
+// is only reached through current().
+type configuredProducer struct {
+	config      ProducerConfig
+	limiter     *rate.Limiter
+	byteLimiter *rate.Limiter
+
+	// createdReported is set once the creation of the producer has been
+	// reported by reportProducerCreated.
+	createDuration  time.Duration
+	createdReported bool
+
+	client   pulsar.Client
+	options  pulsar.ProducerOptions
+	aborting atomic.Bool
+
+	// inflight counts the SendAsync calls still waiting for their callback.
+	inflight atomic.Int64
+
+	// closed is set once the producer or its client has been closed.
+	closed atomic.Bool
+
+	mu       sync.RWMutex
+	producer pulsar.Producer
+	// retired holds the names of the producers replaced by abortBatch whose
+	// replacement has not been reported yet.
+	retired []string
+}
+
+var _ pulsar.Producer = (*configuredProducer)(nil)
+
+// asConfiguredProducer returns the configuredProducer behind producer, looking
+// through a circuit breaker if there is one.
+func asConfiguredProducer(producer pulsar.Producer) (*configuredProducer, bool) {
+	if cb, ok := producer.(*CircuitBreakerProducer); ok {
+		producer = cb.Producer
+	}
+	cp, ok := producer.(*configuredProducer)
+	return cp, ok
+}
+
+func (cp *configuredProducer) current() pulsar.Producer {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.producer
+}
+
+func (cp *configuredProducer) Topic() string { return cp.current().Topic() }
+
+func (cp *configuredProducer) Name() string { return cp.current().Name() }
+
+func (cp *configuredProducer) Send(ctx context.Context, msg *pulsar.ProducerMessage) (pulsar.MessageID, error) {
+	return cp.current().Send(ctx, msg)
+}
+
+func (cp *configuredProducer) SendAsync(
+	ctx context.Context,
+	msg *pulsar.ProducerMessage,
+	callback func(pulsar.MessageID, *pulsar.ProducerMessage, error),
+) {
+	cp.inflight.Add(1)
+	cp.current().SendAsync(ctx, msg, func(id pulsar.MessageID, pm *pulsar.ProducerMessage, err error) {
+		cp.inflight.Add(-1)
+		callback(id, pm, err)
+	})
+}
+
+func (cp *configuredProducer) LastSequenceID() int64 { return cp.current().LastSequenceID() }
+
+func (cp *configuredProducer) Flush() error { return cp.current().Flush() }
+
+func (cp *configuredProducer) Close() {
+	cp.mu.Lock()
+	cp.closed.Store(true)
+	producer := cp.producer
+	cp.mu.Unlock()
+	producer.Close()
+}
+
+// takeRetired returns the names of the producers replaced since the last call.
+func (cp *configuredProducer) takeRetired() []string {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	retired := cp.retired
+	cp.retired = nil
+	return retired
+}
+
+// waitForBytes blocks until n payload bytes fit in the byte budget of the
+// producer. Payloads larger than one second of budget are paid in chunks.
+func (cp *configuredProducer) waitForBytes(ctx context.Context, n int) error {
+	if cp.byteLimiter == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, cp.byteLimiter.Burst())
+		if err := cp.byteLimiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// abortBatch replaces the underlying producer with a new one created from the
+// same options, then drains and closes the old one. If the new producer cannot
+// be created, the old one is kept. Nothing is done while an abort is already
+// in progress. The work happens on its own goroutine because it is triggered from
+// SendAsync callbacks, which run on the producer's event loop where Flush
+// would deadlock.
+func (cp *configuredProducer) abortBatch() {
+	if !cp.aborting.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer cp.aborting.Store(false)
+
+		replacement, err := cp.client.CreateProducer(cp.options)
+		if err != nil {
+			log.Printf("could not recreate producer for topic %s: %v", cp.config.Topic, err)
+			return
+		}
+
+		cp.mu.Lock()
+		if cp.closed.Load() {
+			cp.mu.Unlock()
+			replacement.Close()
+			return
+		}
+		old := cp.producer
+		cp.producer = replacement
+		cp.retired = append(cp.retired, old.Name())
+		cp.mu.Unlock()
+
+		if err := old.Flush(); err != nil {
+			log.Printf("could not flush aborted producer %s: %v", old.Name(), err)
+		}
+		old.Close()
+	}()
+}
@@ -3,12 +3,20 @@ package xpulsar
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apache/pulsar-client-go/pulsar"
 	plog "github.com/apache/pulsar-client-go/pulsar/log"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
 	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/js/modules"
@@ -18,6 +26,8 @@ import (
 var (
 	errNilState        = errors.New("xk6-pubsub: publisher's state is nil")
 	errNilStateOfStats = errors.New("xk6-pubsub: stats's state is nil")
+	errNilProducer     = errors.New("xk6-pulsar: producer is nil")
+	errEmptyTopic      = errors.New("xk6-pulsar: topic must not be empty")
 )
 
 type PublisherStats struct {
@@ -26,76 +36,266 @@ type PublisherStats struct {
 	Messages     int
 	Errors       int
 	Bytes        int64
+	BatchAborts  int
 }
 
 type PulsarMetrics struct {
 	PublishMessages *metrics.Counter
 	PublishBytes    *metrics.Counter
 	PublishErrors   *metrics.Counter
+	BatchAborts     *metrics.Counter
+	Throughput      *metrics.Counter
+	Reconnects      *metrics.Counter
+
+	CircuitBreakerState *metrics.Gauge
+	ProducerState       *metrics.Gauge
+	PublishInflight     *metrics.Gauge
+
+	ProducerCreateDuration *metrics.Trend
 }
 
 type PubSub struct {
-	vu      modules.VU
-	metrics PulsarMetrics
+	vu        modules.VU
+	metrics   PulsarMetrics
+	config    moduleConfig
+	shared    *sharedClients
+	producers *producerRegistry
+	tagSets   *cardinalityLimiter
+}
+
+// sharedClients holds the clients created by NewSharedClient. It lives in the
+// root module, so every VU instance sees the same clients.
+type sharedClients struct {
+	mu      sync.Mutex
+	clients map[string]pulsar.Client
+}
+
+// producerRegistry tracks the producers created by every VU, in creation
+// order, so TeardownAll can release the ones the script did not close. It
+// lives in the root module because k6 runs teardown() on a VU of its own.
+type producerRegistry struct {
+	mu        sync.Mutex
+	producers []*configuredProducer
+}
+
+func (r *producerRegistry) add(cp *configuredProducer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.producers = append(r.producers, cp)
+}
+
+func (r *producerRegistry) remove(cp *configuredProducer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, tracked := range r.producers {
+		if tracked == cp {
+			r.producers = append(r.producers[:i], r.producers[i+1:]...)
+			return
+		}
+	}
+}
+
+// removeClient untracks the producers created from client and marks them
+// closed, since closing a client closes its producers too.
+func (r *producerRegistry) removeClient(client pulsar.Client) []*configuredProducer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var removed []*configuredProducer
+	kept := r.producers[:0]
+	for _, tracked := range r.producers {
+		if tracked.client == client {
+			tracked.closed.Store(true)
+			removed = append(removed, tracked)
+			continue
+		}
+		kept = append(kept, tracked)
+	}
+	r.producers = kept
+	return removed
+}
+
+func (r *producerRegistry) removeAll() []*configuredProducer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	producers := r.producers
+	r.producers = nil
+	return producers
 }
 
 func init() {
 	modules.Register("k6/x/pulsar", New)
 }
 
-func New() *PubSub { return &PubSub{} }
+func New() *PubSub {
+	return &PubSub{
+		shared:    &sharedClients{clients: make(map[string]pulsar.Client)},
+		producers: &producerRegistry{},
+		tagSets:   &cardinalityLimiter{seen: make(map[string]struct{})},
+	}
+}
 
 type PulsarClientConfig struct {
 	URL               string
 	ConnectionTimeout time.Duration
+	// ReconnectBackoffPolicy retries creating the producers of the client on
+	// transient network errors. The client itself only connects once it is
+	// used, so creating it is not retried.
+	ReconnectBackoffPolicy *BackoffPolicyConfig
+	// ClusterName identifies the cluster in a MultiClusterClientConfig.
+	ClusterName string
+	// LogOutput receives the log output of the client. It defaults to
+	// os.Stderr.
+	LogOutput io.Writer
+}
+
+// configuredClient keeps the PulsarClientConfig next to the pulsar.Client it
+// was created from, so CreateProducer can apply its reconnect policy.
+type configuredClient struct {
+	pulsar.Client
+	config PulsarClientConfig
+	pubsub *PubSub
+
+	// reconnects counts the reconnect attempts not reported yet.
+	reconnects *atomic.Int64
 }
 
 type ProducerConfig struct {
-	Topic               string
-	CompressionType     pulsar.CompressionType
-	BatchingMaxMessages uint
-	MaxPendingMessages  int
-	SendTimeout         time.Duration
+	Topic                string
+	CompressionType      pulsar.CompressionType
+	BatchingMaxMessages  uint
+	MaxPendingMessages   int
+	SendTimeout          time.Duration
+	ReplicationClusters  []string
+	ProducerInterceptors []ProducerInterceptorConfig
+	// BatchingEnabled defaults to true when left unset.
+	BatchingEnabled *bool
+	// MaxPublishRate caps Publish calls on the producer, in messages per
+	// second. Zero means unlimited.
+	MaxPublishRate float64
+	// AbortBatchOnError drains, closes and recreates the producer when an
+	// async publish fails.
+	AbortBatchOnError bool
+	// MaxPublishBytesPerSecond caps the payload bytes published by the
+	// producer per second. Zero means unlimited.
+	MaxPublishBytesPerSecond int64
+	// DeduplicationEnabled reports messages the broker dropped as duplicates
+	// with ErrDuplicate. Deduplication itself must be enabled on the
+	// namespace or topic.
+	DeduplicationEnabled bool
 }
 
 func (p *PubSub) XModuleInstance(vu modules.VU) modules.Instance {
-	registry := vu.InitEnv().Registry
-	m, err := registerMetrics(registry)
+	initEnv := vu.InitEnv()
+	config, err := loadModuleConfig(initEnv.LookupEnv)
+	if err != nil {
+		common.Throw(vu.Runtime(), err)
+	}
+	m, err := registerMetrics(initEnv.Registry, config.MetricsPrefix)
 	if err != nil {
 		common.Throw(vu.Runtime(), err)
 	}
 
 	return &PubSub{
-		vu:      vu,
-		metrics: m,
+		vu:        vu,
+		metrics:   m,
+		config:    config,
+		shared:    p.shared,
+		producers: p.producers,
+		tagSets:   p.tagSets,
 	}
 }
 
 func (p *PubSub) Exports() modules.Exports {
 	return modules.Exports{
 		Named: map[string]interface{}{
-			"createClient":   p.CreateClient,
-			"createProducer": p.CreateProducer,
-			"publish":        p.Publish,
-			"closeClient":    p.CloseClient,
-			"closeProducer":  p.CloseProducer,
+			"createClient":              p.CreateClient,
+			"createProducer":            p.CreateProducer,
+			"newSharedClient":           p.NewSharedClient,
+			"newCircuitBreakerProducer": p.NewCircuitBreakerProducer,
+			"withClient":                p.WithClient,
+			"createMultiClusterClient":  p.CreateMultiClusterClient,
+			"publishToCluster":          p.PublishToCluster,
+			"publish":                   p.Publish,
+			"closeClient":               p.CloseClient,
+			"closeProducer":             p.CloseProducer,
+			"teardownAll":               p.TeardownAll,
+
+			"getTopicMetadata":          p.GetTopicMetadata,
+			"assignPartitionsToVU":      p.AssignPartitionsToVU,
+			"validateOrdering":          p.ValidateOrdering,
+			"validateMessageProperties": p.ValidateMessageProperties,
+			"parseTopicURL":             p.ParseTopicURL,
+
+			"adminGetSubscriptionStats":      p.AdminGetSubscriptionStats,
+			"adminGetProducerStats":          p.AdminGetProducerStats,
+			"adminSetMessageTTL":             p.AdminSetMessageTTL,
+			"adminSetRetentionPolicy":        p.AdminSetRetentionPolicy,
+			"adminSetBacklogQuota":           p.AdminSetBacklogQuota,
+			"adminGetBrokerHealth":           p.AdminGetBrokerHealth,
+			"adminListBrokers":               p.AdminListBrokers,
+			"adminCreateTenant":              p.AdminCreateTenant,
+			"adminDeleteTenant":              p.AdminDeleteTenant,
+			"adminGetNamespacePolicies":      p.AdminGetNamespacePolicies,
+			"adminTriggerOffload":            p.AdminTriggerOffload,
+			"adminGetOffloadPolicies":        p.AdminGetOffloadPolicies,
+			"adminSetNamespaceDispatchRate":  p.AdminSetNamespaceDispatchRate,
+			"adminSetPublishRate":            p.AdminSetPublishRate,
+			"adminSetSubscribeRate":          p.AdminSetSubscribeRate,
+			"adminGetReplicationStatus":      p.AdminGetReplicationStatus,
+			"adminTriggerFunction":           p.AdminTriggerFunction,
+			"adminGetFunctionStatus":         p.AdminGetFunctionStatus,
+			"adminGetSinkStatus":             p.AdminGetSinkStatus,
+			"adminGetSourceStatus":           p.AdminGetSourceStatus,
+			"adminCreateNonPartitionedTopic": p.AdminCreateNonPartitionedTopic,
+			"adminCreatePartitionedTopic":    p.AdminCreatePartitionedTopic,
+			"adminListNonPartitionedTopics":  p.AdminListNonPartitionedTopics,
+			"adminListPartitionedTopics":     p.AdminListPartitionedTopics,
+			"adminUpdatePartitionedTopic":    p.AdminUpdatePartitionedTopic,
 		},
 	}
 }
 
-func registerMetrics(registry *metrics.Registry) (PulsarMetrics, error) {
+func registerMetrics(registry *metrics.Registry, prefix string) (PulsarMetrics, error) {
 	var err error
 	m := PulsarMetrics{}
 
-	m.PublishMessages, err = registry.NewMetric("pulsar.publish.message.count", metrics.Counter)
+	m.PublishMessages, err = registry.NewMetric(prefix+"pulsar.publish.message.count", metrics.Counter)
 	if err != nil {
 		return m, err
 	}
-	m.PublishBytes, err = registry.NewMetric("pulsar.publish.message.bytes", metrics.Counter, metrics.Data)
+	m.PublishBytes, err = registry.NewMetric(prefix+"pulsar.publish.message.bytes", metrics.Counter, metrics.Data)
 	if err != nil {
 		return m, err
 	}
-	m.PublishErrors, err = registry.NewMetric("pulsar.publish.error.count", metrics.Counter)
+	m.PublishErrors, err = registry.NewMetric(prefix+"pulsar.publish.error.count", metrics.Counter)
+	if err != nil {
+		return m, err
+	}
+	m.BatchAborts, err = registry.NewMetric(prefix+"pulsar.publish.batch.abort.count", metrics.Counter)
+	if err != nil {
+		return m, err
+	}
+	m.Throughput, err = registry.NewMetric(prefix+"pulsar.publish.throughput.bytes", metrics.Counter, metrics.Data)
+	if err != nil {
+		return m, err
+	}
+	m.Reconnects, err = registry.NewMetric(prefix+"pulsar.client.reconnect.count", metrics.Counter)
+	if err != nil {
+		return m, err
+	}
+	m.CircuitBreakerState, err = registry.NewMetric(prefix+"pulsar.producer.circuit_breaker.state", metrics.Gauge)
+	if err != nil {
+		return m, err
+	}
+	m.ProducerState, err = registry.NewMetric(prefix+"pulsar.producer.state", metrics.Gauge)
+	if err != nil {
+		return m, err
+	}
+	m.PublishInflight, err = registry.NewMetric(prefix+"pulsar.publish.inflight.count", metrics.Gauge)
+	if err != nil {
+		return m, err
+	}
+	m.ProducerCreateDuration, err = registry.NewMetric(prefix+"pulsar.producer.create.duration", metrics.Trend, metrics.Time)
 	if err != nil {
 		return m, err
 	}
@@ -103,35 +303,171 @@ func registerMetrics(registry *metrics.Registry) (PulsarMetrics, error) {
 	return m, nil
 }
 
+// validateURL checks that rawURL uses one of the schemes the Pulsar client
+// understands, so a typo is reported as such instead of as a connection error.
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return invalidConfiguration(fmt.Errorf("invalid URL %q: %w", rawURL, err))
+	}
+	switch u.Scheme {
+	case "pulsar", "pulsar+ssl", "http", "https":
+		return nil
+	}
+	return invalidConfiguration(fmt.Errorf(
+		"invalid URL scheme %q in %q, expected pulsar://, pulsar+ssl://, http:// or https://",
+		u.Scheme, rawURL,
+	))
+}
+
 func (p *PubSub) CreateClient(clientConfig PulsarClientConfig) (pulsar.Client, error) {
-	logger := logrus.StandardLogger()
+	if err := validateURL(clientConfig.URL); err != nil {
+		return nil, err
+	}
+
+	// Each client gets its own logger, so clients do not share the level and
+	// output of the global one.
+	logger := logrus.New()
 	logger.SetLevel(logrus.ErrorLevel)
+	if clientConfig.LogOutput != nil {
+		logger.SetOutput(clientConfig.LogOutput)
+	}
 
 	connectionTimeout := 3 * time.Second
 	if clientConfig.ConnectionTimeout > 0 {
 		connectionTimeout = clientConfig.ConnectionTimeout
 	}
 
+	reconnects := new(atomic.Int64)
 	client, err := pulsar.NewClient(pulsar.ClientOptions{
 		URL:               clientConfig.URL,
 		ConnectionTimeout: connectionTimeout,
-		Logger:            plog.NewLoggerWithLogrus(logger),
+		Logger:            reconnectLogger{Logger: plog.NewLoggerWithLogrus(logger), reconnects: reconnects},
 	})
+	if err != nil {
+		return nil, wrapPulsarError(err, "")
+	}
+	return &configuredClient{
+		Client:     client,
+		config:     clientConfig,
+		pubsub:     p,
+		reconnects: reconnects,
+	}, nil
+}
+
+// Close untracks the producers of the client and reports them closed before
+// closing it, which closes them too. This also covers client.close() in
+// scripts and MultiClusterClient.Close, which do not go through CloseClient.
+func (cc *configuredClient) Close() {
+	for _, cp := range cc.pubsub.producers.removeClient(cc) {
+		cc.pubsub.reportProducerState(cp, 0)
+	}
+	cc.Client.Close()
+}
+
+// NewSharedClient returns a client shared by all VUs, creating it on the first
+// call for clientConfig.URL. Later calls for the same URL must pass the same
+// config. Calling it from the init context lets thousands of VUs reuse one set
+// of broker connections. A shared client must only be closed once, in
+// teardown.
+func (p *PubSub) NewSharedClient(clientConfig PulsarClientConfig) (pulsar.Client, error) {
+	p.shared.mu.Lock()
+	defer p.shared.mu.Unlock()
+
+	if client, ok := p.shared.clients[clientConfig.URL]; ok {
+		if cc, ok := client.(*configuredClient); ok && !reflect.DeepEqual(cc.config, clientConfig) {
+			return nil, invalidConfiguration(fmt.Errorf(
+				"shared client for %s already exists with a different config", clientConfig.URL,
+			))
+		}
+		return client, nil
+	}
+
+	client, err := p.CreateClient(clientConfig)
 	if err != nil {
 		return nil, err
 	}
+	p.shared.clients[clientConfig.URL] = client
 	return client, nil
 }
 
+// WithClient creates a client, calls fn with it and closes the client once fn
+// returns, including when fn throws. Panics raised while fn runs are re-thrown
+// to the script as k6 errors after the client is closed.
+func (p *PubSub) WithClient(clientConfig PulsarClientConfig, fn func(client pulsar.Client)) error {
+	client, err := p.CreateClient(clientConfig)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		p.CloseClient(client)
+		if r := recover(); r != nil {
+			if e, ok := r.(error); ok {
+				common.Throw(p.vu.Runtime(), e)
+			}
+			common.Throw(p.vu.Runtime(), fmt.Errorf("xk6-pulsar: %v", r))
+		}
+	}()
+
+	fn(client)
+	return nil
+}
+
 func (p *PubSub) CloseClient(client pulsar.Client) {
+	if client == nil {
+		return
+	}
+	for _, cp := range p.producers.removeClient(client) {
+		p.reportProducerState(cp, 0)
+	}
 	client.Close()
 }
 
 func (p *PubSub) CloseProducer(producer pulsar.Producer) {
+	if producer == nil {
+		return
+	}
+	// The producers are tracked unwrapped, so a circuit breaker is looked
+	// through.
+	if cp, ok := asConfiguredProducer(producer); ok {
+		p.producers.remove(cp)
+	}
 	producer.Close()
+	p.reportProducerState(producer, 0)
+}
+
+// TeardownAll flushes every producer of every VU that is still open and then
+// closes them in the order they were created. modules.Instance has no
+// shutdown hook, so scripts call it from teardown(), which k6 runs once the
+// other VUs are done. Producers closed by the script, directly or through
+// their client, are skipped: flushing a closed producer never returns.
+func (p *PubSub) TeardownAll() error {
+	var producers []*configuredProducer
+	for _, cp := range p.producers.removeAll() {
+		if !cp.closed.Load() {
+			producers = append(producers, cp)
+		}
+	}
+
+	var errs []error
+	for _, cp := range producers {
+		if err := cp.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush producer %s: %w", cp.Name(), err))
+		}
+	}
+	for _, cp := range producers {
+		cp.Close()
+		p.reportProducerState(cp, 0)
+	}
+	return errors.Join(errs...)
 }
 
 func (p *PubSub) CreateProducer(client pulsar.Client, config ProducerConfig) (pulsar.Producer, error) {
+	if config.Topic == "" {
+		return nil, errEmptyTopic
+	}
+
 	batchingMaxMessages := uint(100)
 	if config.BatchingMaxMessages > 0 {
 		batchingMaxMessages = config.BatchingMaxMessages
@@ -147,6 +483,15 @@ func (p *PubSub) CreateProducer(client pulsar.Client, config ProducerConfig) (pu
 		sendTimeout = config.SendTimeout
 	}
 
+	interceptors := make(pulsar.ProducerInterceptors, 0, len(config.ProducerInterceptors))
+	for _, interceptorConfig := range config.ProducerInterceptors {
+		interceptor, err := newJSProducerInterceptor(p.vu.Runtime(), interceptorConfig)
+		if err != nil {
+			return nil, err
+		}
+		interceptors = append(interceptors, interceptor)
+	}
+
 	option := pulsar.ProducerOptions{
 		Topic:               config.Topic,
 		Schema:              pulsar.NewStringSchema(nil),
@@ -155,13 +500,95 @@ func (p *PubSub) CreateProducer(client pulsar.Client, config ProducerConfig) (pu
 		BatchingMaxMessages: batchingMaxMessages,
 		MaxPendingMessages:  maxPendingMessages,
 		SendTimeout:         sendTimeout,
+		Interceptors:        interceptors,
+		DisableBatching:     config.BatchingEnabled != nil && !*config.BatchingEnabled,
+	}
+
+	var reconnectPolicy *BackoffPolicyConfig
+	if cc, ok := client.(*configuredClient); ok {
+		reconnectPolicy = cc.config.ReconnectBackoffPolicy
+	}
+
+	started := time.Now()
+	var producer pulsar.Producer
+	err := retry(reconnectPolicy, func() (err error) {
+		producer, err = client.CreateProducer(option)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("topic=%s: %w", config.Topic, wrapPulsarError(err, config.Topic))
+	}
+	configured := &configuredProducer{
+		config:   config,
+		client:   client,
+		options:  option,
+		producer: producer,
+
+		createDuration: time.Since(started),
+	}
+	if config.MaxPublishRate > 0 {
+		configured.limiter = rate.NewLimiter(rate.Limit(config.MaxPublishRate), 1)
+	}
+	if config.MaxPublishBytesPerSecond > 0 {
+		configured.byteLimiter = rate.NewLimiter(
+			rate.Limit(config.MaxPublishBytesPerSecond), int(config.MaxPublishBytesPerSecond),
+		)
+	}
+	configured.createdReported = p.reportProducerCreated(configured)
+	p.producers.add(configured)
+	return configured, nil
+}
+
+// GetTopicMetadata returns the partitions and the persistence type of topic.
+// As in Pulsar, partitions is 0 for a topic that is not partitioned; its
+// partitionNames then hold the topic itself. Schema information is not
+// exposed by pulsar.Client and is not included.
+func (p *PubSub) GetTopicMetadata(client pulsar.Client, topic string) (map[string]interface{}, error) {
+	components, err := parseTopicURL(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions, err := client.TopicPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client names the partitions after topic as given, and returns the
+	// fully qualified topic for one that is not partitioned.
+	count := len(partitions)
+	if count == 1 && partitions[0] != topic+partitionSuffix+"0" {
+		count = 0
 	}
 
-	producer, err := client.CreateProducer(option)
+	return map[string]interface{}{
+		"partitions":     count,
+		"partitionNames": partitions,
+		"persistence":    components.Persistence,
+	}, nil
+}
+
+// AssignPartitionsToVU splits the partitions of topic between totalVUs VUs and
+// returns the ones belonging to vuID: partition i goes to the VU for which
+// vuID % totalVUs == i % totalVUs. Passing __VU and the VU count gives every
+// partition to exactly one VU.
+func (p *PubSub) AssignPartitionsToVU(client pulsar.Client, topic string, vuID int, totalVUs int) ([]string, error) {
+	if totalVUs <= 0 {
+		return nil, fmt.Errorf("xk6-pulsar: totalVUs must be positive, got %d", totalVUs)
+	}
+
+	partitions, err := client.TopicPartitions(topic)
 	if err != nil {
 		return nil, err
 	}
-	return producer, nil
+
+	assigned := make([]string, 0, len(partitions)/totalVUs+1)
+	for i, partition := range partitions {
+		if i%totalVUs == vuID%totalVUs {
+			assigned = append(assigned, partition)
+		}
+	}
+	return assigned, nil
 }
 
 func (p *PubSub) Publish(
@@ -175,6 +602,9 @@ func (p *PubSub) Publish(
 	if state == nil {
 		return errNilState
 	}
+	if producer == nil {
+		return errNilProducer
+	}
 
 	currentStats := PublisherStats{
 		Topic:        producer.Topic(),
@@ -189,6 +619,37 @@ func (p *PubSub) Publish(
 		Properties: properties,
 	}
 
+	var deduplication bool
+	if cp, ok := asConfiguredProducer(producer); ok {
+		// pulsar.ProducerOptions has no replication clusters setting, so it is
+		// applied to every message sent by the producer instead.
+		msg.ReplicationClusters = cp.config.ReplicationClusters
+		deduplication = cp.config.DeduplicationEnabled
+		if !cp.createdReported {
+			cp.createdReported = p.reportProducerCreated(cp)
+		}
+
+		var err error
+		if cp.limiter != nil {
+			err = cp.limiter.Wait(ctx)
+		}
+		if err == nil {
+			err = cp.waitForBytes(ctx, len(body))
+		}
+		if err != nil {
+			// A publish that cannot get through the rate limits, e.g. because
+			// the iteration ended, fails like a send.
+			currentStats.Errors++
+			if errStats := p.ReportPublishMetrics(ctx, currentStats); errStats != nil {
+				log.Printf("could not report rate limited publish metrics: %v", errStats)
+			}
+			return fmt.Errorf("vu=%d topic=%s: %w", state.VUID, currentStats.Topic, err)
+		}
+		p.reportProducerReplaced(cp)
+		p.reportInflight(cp)
+		p.reportReconnects(cp)
+	}
+
 	// async send
 	if async {
 		producer.SendAsync(
@@ -196,10 +657,27 @@ func (p *PubSub) Publish(
 			msg,
 			func(mi pulsar.MessageID, pm *pulsar.ProducerMessage, e error) {
 				currentStats.Messages = 1
+				if e == nil && deduplication && isDuplicate(mi) {
+					e = ErrDuplicate
+				}
 				if e != nil {
 					currentStats.Errors++
+					cp, ok := asConfiguredProducer(producer)
+					// Rejections by an open circuit breaker did not reach the
+					// broker, so there is no batch to abort.
+					// The abort is counted once the producer has been replaced,
+					// by reportProducerReplaced.
+					if ok && cp.config.AbortBatchOnError && !errors.Is(e, ErrDuplicate) && !errors.Is(e, ErrCircuitOpen) {
+						cp.abortBatch()
+					}
+				}
+				// The callback may run after k6 cancelled the iteration, when the
+				// VU state is already gone.
+				if ctx.Err() != nil {
+					log.Printf("skipping async publish metrics, context is done: %v", ctx.Err())
+					return
 				}
-				if errStats := p.ReportPubishMetrics(ctx, currentStats); errStats != nil {
+				if errStats := p.ReportPublishMetrics(ctx, currentStats); errStats != nil {
 					log.Printf("could not report async publish metrics: %v", errStats)
 				}
 			},
@@ -208,33 +686,160 @@ func (p *PubSub) Publish(
 		return nil
 	}
 
-	_, err := producer.Send(ctx, msg)
+	id, err := producer.Send(ctx, msg)
+	if err == nil && deduplication && isDuplicate(id) {
+		err = ErrDuplicate
+	}
 	if err != nil {
 		currentStats.Errors++
 	}
 
-	if errStats := p.ReportPubishMetrics(ctx, currentStats); errStats != nil {
+	if errStats := p.ReportPublishMetrics(ctx, currentStats); errStats != nil {
 		// Log the error instead of fatally stopping the test
 		log.Printf("could not report sync publish metrics: %v", errStats)
 	}
-	return err
+	if err != nil {
+		return fmt.Errorf("vu=%d topic=%s: %w", state.VUID, currentStats.Topic, wrapPulsarError(err, currentStats.Topic))
+	}
+	return nil
 }
 
-func (p *PubSub) ReportPubishMetrics(ctx context.Context, currentStats PublisherStats) error {
+// metricTags returns the tags of the metrics of a producer, capped to the
+// configured cardinality.
+func (p *PubSub) metricTags(producerName, topic string) []string {
+	tags := topicTags(producerName, topic)
+	if state := p.vu.State(); state != nil {
+		if p.config.IncludeVUTag {
+			tags = append(tags, "vu_id", strconv.FormatUint(state.VUID, 10))
+		}
+		if p.config.IncludeIterationTag {
+			tags = append(tags, "iteration", strconv.FormatInt(state.Iteration, 10))
+		}
+	}
+	return p.tagSets.limit(p.config.MaxMetricCardinality, tags)
+}
+
+// stateTags returns the tags of the gauges that track the state of a
+// producer. They leave out the VU and iteration tags, so that every update of
+// a state lands in the same series.
+func (p *PubSub) stateTags(producerName, topic string) []string {
+	return p.tagSets.limit(p.config.MaxMetricCardinality, topicTags(producerName, topic))
+}
+
+// reportProducerCreated sets the pulsar.producer.state gauge of cp to 1 and
+// records how long creating it took. It returns false when there is no VU
+// state to report with, as in the init context; the creation of such a
+// producer is reported by its first publish instead.
+func (p *PubSub) reportProducerCreated(cp *configuredProducer) bool {
+	state := p.vu.State()
+	if state == nil {
+		return false
+	}
+
+	gaugeTags := metrics.NewTags(p.stateTags(cp.Name(), cp.Topic())...)
+	p.metrics.ProducerState.WithTags(gaugeTags).Set(1)
+	tags := metrics.NewTags(p.metricTags(cp.Name(), cp.Topic())...)
+	p.metrics.ProducerCreateDuration.WithTags(tags).Add(metrics.D(cp.createDuration))
+	metrics.PushIfNotDone(p.vu.Context(), state.Samples)
+	return true
+}
+
+// reportProducerReplaced moves the pulsar.producer.state gauge from the
+// producers abortBatch replaced to the current producer of cp, and counts each
+// replacement in pulsar.publish.batch.abort.count. abortBatch runs outside any
+// VU, so the swap is reported by the next publish.
+func (p *PubSub) reportProducerReplaced(cp *configuredProducer) {
+	state := p.vu.State()
+	if state == nil {
+		return
+	}
+	retired := cp.takeRetired()
+	if len(retired) == 0 {
+		return
+	}
+
+	for _, name := range retired {
+		tags := metrics.NewTags(p.stateTags(name, cp.Topic())...)
+		p.metrics.ProducerState.WithTags(tags).Set(0)
+		abortTags := metrics.NewTags(p.metricTags(name, cp.Topic())...)
+		p.metrics.BatchAborts.WithTags(abortTags).Add(1)
+	}
+	tags := metrics.NewTags(p.stateTags(cp.Name(), cp.Topic())...)
+	p.metrics.ProducerState.WithTags(tags).Set(1)
+	metrics.PushIfNotDone(p.vu.Context(), state.Samples)
+}
+
+// reportInflight sets the pulsar.publish.inflight.count gauge of cp to the
+// number of its async sends that have not been acknowledged yet.
+func (p *PubSub) reportInflight(cp *configuredProducer) {
+	state := p.vu.State()
+	if state == nil {
+		return
+	}
+
+	tags := metrics.NewTags(p.stateTags(cp.Name(), cp.Topic())...)
+	p.metrics.PublishInflight.WithTags(tags).Set(float64(cp.inflight.Load()))
+	metrics.PushIfNotDone(p.vu.Context(), state.Samples)
+}
+
+// reportReconnects adds the reconnect attempts of the client of cp since the
+// last report to the pulsar.client.reconnect.count counter. The client logs
+// them on its own goroutines, so they are reported by the next publish.
+func (p *PubSub) reportReconnects(cp *configuredProducer) {
+	cc, ok := cp.client.(*configuredClient)
+	if !ok {
+		return
+	}
+	state := p.vu.State()
+	if state == nil {
+		return
+	}
+	n := cc.reconnects.Swap(0)
+	if n == 0 {
+		return
+	}
+
+	tags := metrics.NewTags(p.metricTags(cp.Name(), cp.Topic())...)
+	p.metrics.Reconnects.WithTags(tags).Add(float64(n))
+	metrics.PushIfNotDone(p.vu.Context(), state.Samples)
+}
+
+// reportProducerState sets the pulsar.producer.state gauge of producer to
+// value, if there is VU state to report with.
+func (p *PubSub) reportProducerState(producer pulsar.Producer, value float64) {
+	state := p.vu.State()
+	if state == nil {
+		return
+	}
+
+	tags := metrics.NewTags(p.stateTags(producer.Name(), producer.Topic())...)
+	p.metrics.ProducerState.WithTags(tags).Set(value)
+	metrics.PushIfNotDone(p.vu.Context(), state.Samples)
+}
+
+func (p *PubSub) ReportPublishMetrics(ctx context.Context, currentStats PublisherStats) error {
 	state := p.vu.State()
 	if state == nil {
 		return errNilStateOfStats
 	}
 
-	tags := metrics.NewTags(
-		"producer_name", currentStats.ProducerName,
-		"topic", currentStats.Topic,
-	)
+	tags := metrics.NewTags(p.metricTags(currentStats.ProducerName, currentStats.Topic)...)
 
 	p.metrics.PublishMessages.WithTags(tags).Add(float64(currentStats.Messages))
 	p.metrics.PublishErrors.WithTags(tags).Add(float64(currentStats.Errors))
 	p.metrics.PublishBytes.WithTags(tags).Add(float64(currentStats.Bytes))
+	p.metrics.BatchAborts.WithTags(tags).Add(float64(currentStats.BatchAborts))
+	if currentStats.Errors == 0 {
+		p.metrics.Throughput.WithTags(tags).Add(float64(currentStats.Bytes))
+	}
 
 	metrics.PushIfNotDone(ctx, state.Samples)
 	return nil
 }
+
+// ReportPubishMetrics is the misspelled former name of ReportPublishMetrics.
+//
+// Deprecated: use ReportPublishMetrics.
+func (p *PubSub) ReportPubishMetrics(ctx context.Context, currentStats PublisherStats) error {
+	return p.ReportPublishMetrics(ctx, currentStats)
+}
@@ -0,0 +1,32 @@
+package xpulsar
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	plog "github.com/apache/pulsar-client-go/pulsar/log"
+)
+
+// reconnectMessage is logged by pulsar-client-go v0.8.0 each time a producer
+// or consumer schedules a reconnect to its broker.
+const reconnectMessage = "Reconnecting to broker in "
+
+// reconnectLogger counts the reconnect attempts logged by the client before
+// passing every line on to the wrapped logger. The attempts are logged at
+// info level, which the wrapped logger usually drops.
+type reconnectLogger struct {
+	plog.Logger
+	reconnects *atomic.Int64
+}
+
+func (l reconnectLogger) SubLogger(fields plog.Fields) plog.Logger {
+	return reconnectLogger{Logger: l.Logger.SubLogger(fields), reconnects: l.reconnects}
+}
+
+func (l reconnectLogger) Info(args ...interface{}) {
+	if strings.HasPrefix(fmt.Sprint(args...), reconnectMessage) {
+		l.reconnects.Add(1)
+	}
+	l.Logger.Info(args...)
+}
@@ -0,0 +1,73 @@
+package xpulsar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const partitionSuffix = "-partition-"
+
+// TopicComponents are the parts of a fully qualified Pulsar topic name such
+// as persistent://public/default/my-topic-partition-0. Partition is empty for
+// a topic that is not a partition.
+type TopicComponents struct {
+	Persistence string
+	Tenant      string
+	Namespace   string
+	Topic       string
+	Partition   string
+}
+
+// ParseTopicURL splits a topic name into its components. Short names like
+// my-topic are resolved to persistent://public/default, as in the Pulsar
+// client.
+func (p *PubSub) ParseTopicURL(topic string) (TopicComponents, error) {
+	return parseTopicURL(topic)
+}
+
+func parseTopicURL(topic string) (TopicComponents, error) {
+	c := TopicComponents{Persistence: "persistent"}
+
+	rest := topic
+	if i := strings.Index(topic, "://"); i >= 0 {
+		c.Persistence, rest = topic[:i], topic[i+len("://"):]
+		if c.Persistence != "persistent" && c.Persistence != "non-persistent" {
+			return TopicComponents{}, fmt.Errorf("xk6-pulsar: invalid topic domain %q in %q", c.Persistence, topic)
+		}
+	}
+
+	parts := strings.Split(rest, "/")
+	switch len(parts) {
+	case 1:
+		c.Tenant, c.Namespace, c.Topic = "public", "default", parts[0]
+	case 3:
+		c.Tenant, c.Namespace, c.Topic = parts[0], parts[1], parts[2]
+	default:
+		return TopicComponents{}, fmt.Errorf("xk6-pulsar: invalid topic name %q", topic)
+	}
+	if c.Tenant == "" || c.Namespace == "" || c.Topic == "" {
+		return TopicComponents{}, fmt.Errorf("xk6-pulsar: invalid topic name %q", topic)
+	}
+
+	if i := strings.LastIndex(c.Topic, partitionSuffix); i > 0 {
+		partition := c.Topic[i+len(partitionSuffix):]
+		if _, err := strconv.Atoi(partition); err == nil {
+			c.Topic, c.Partition = c.Topic[:i], partition
+		}
+	}
+	return c, nil
+}
+
+// topicTags returns the metric tags identifying a producer and its topic.
+// The tenant and namespace tags are left out if the topic cannot be parsed.
+func topicTags(producerName, topic string) []string {
+	tags := []string{
+		"producer_name", producerName,
+		"topic", topic,
+	}
+	if c, err := parseTopicURL(topic); err == nil {
+		tags = append(tags, "tenant", c.Tenant, "namespace", c.Namespace)
+	}
+	return tags
+}
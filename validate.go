@@ -0,0 +1,53 @@
+package xpulsar
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ValidateOrdering reports whether, for every value of keyField, the messages
+// carrying that value appear in ascending "sequenceId" order. Messages without
+// a numeric sequenceId make the check fail.
+func (p *PubSub) ValidateOrdering(msgs []map[string]interface{}, keyField string) bool {
+	last := make(map[string]int64)
+	for _, msg := range msgs {
+		seq, ok := toInt64(msg["sequenceId"])
+		if !ok {
+			return false
+		}
+
+		key := fmt.Sprint(msg[keyField])
+		if prev, seen := last[key]; seen && seq <= prev {
+			return false
+		}
+		last[key] = seq
+	}
+	return true
+}
+
+// ValidateMessageProperties returns the keys of schema that props lacks, in
+// sorted order. Only the keys of schema are checked; its values are ignored.
+func (p *PubSub) ValidateMessageProperties(props map[string]string, schema map[string]string) []string {
+	missing := []string{}
+	for key := range schema {
+		if _, ok := props[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// toInt64 converts the numeric types goja exports JS numbers as.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		return int64(n), n == float64(int64(n))
+	default:
+		return 0, false
+	}
+}